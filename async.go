@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	sparta "github.com/mweagle/Sparta"
+	spartaAWSResource "github.com/mweagle/Sparta/aws/cloudformation/resources"
+	"github.com/mweagle/Sparta/aws/step"
+	"github.com/sirupsen/logrus"
+)
+
+// asyncNotifyLambdaInfo is the terminal Lambda task state every async
+// custom resource's state machine ends on; it's registered once in
+// customResourceHooks() before any AsyncCreate/AsyncUpdate/AsyncDelete
+// method builds a state machine that references it.
+var asyncNotifyLambdaInfo *sparta.LambdaAWSInfo
+
+// asyncStateMachineArnEnvVar is the Lambda environment variable
+// asyncDispatchHandler reads the deployed state machine's ARN from. It's
+// populated at template-build time with a gocf.Ref to the state machine
+// resource, so the real ARN is only known once CloudFormation resolves it.
+const asyncStateMachineArnEnvVar = "ASYNC_STATE_MACHINE_ARN"
+
+////////////////////////////////////////////////////////////////////////////////
+// Asynchronous custom resource provisioning via Step Functions
+//
+// CloudFormationLambdaCustomResourceHandler (what EnsureCustomResourceHandler
+// wires up for SpartaHelloWorldResource) always PUTs the CloudFormation
+// response the instant Create/Update/Delete returns, which is fine for
+// work that completes inside the Lambda's own timeout but wrong for
+// anything longer. asyncResourceHandler instead describes that work as a
+// Step Functions state machine: asyncDispatchHandler is a thin Lambda that
+// starts an execution and returns immediately (without ever touching
+// event.ResponseURL), and the machine's terminal state
+// (asyncNotifyCloudFormation) is the one that eventually PUTs the real
+// result, long after the dispatching Lambda invocation has ended.
+
+// asyncResourceHandler is satisfied by custom resources whose provisioning
+// work can outlive a single Lambda invocation. customResourceHooks calls
+// only AsyncCreate, once, at template-build time, and
+// ensureAsyncCustomResourceHandler wires the result into the template via
+// step.StateMachine's own StateMachineNamedDecorator hook.
+// asyncDispatchHandler starts that one machine for every RequestType;
+// AsyncUpdate and AsyncDelete are not called.
+type asyncResourceHandler interface {
+	AsyncCreate(logger *logrus.Logger) (*step.StateMachine, error)
+	AsyncUpdate(logger *logrus.Logger) (*step.StateMachine, error)
+	AsyncDelete(logger *logrus.Logger) (*step.StateMachine, error)
+}
+
+// asyncIdempotencyKey derives a stable key from the fields CloudFormation
+// guarantees are unique per logical invocation, so a retried/replayed Lambda
+// invocation doesn't start a second, duplicate state machine execution.
+func asyncIdempotencyKey(event *spartaAWSResource.CloudFormationLambdaEvent) string {
+	return fmt.Sprintf("%s-%s", event.LogicalResourceID, event.RequestID)
+}
+
+// startAsyncExecution starts the state machine identified by
+// stateMachineArn under an idempotency key derived from event. A replayed
+// invocation resolves to the same execution name, so AWS itself rejects the
+// duplicate start with ExecutionAlreadyExists; that case is treated as
+// success rather than surfaced as an error.
+func startAsyncExecution(awsSession *session.Session,
+	stateMachineArn string,
+	event *spartaAWSResource.CloudFormationLambdaEvent,
+	logger *logrus.Logger) error {
+
+	input, marshalErr := json.Marshal(map[string]interface{}{
+		"responseURL":       event.ResponseURL,
+		"stackId":           event.StackID,
+		"logicalResourceId": event.LogicalResourceID,
+		"requestId":         event.RequestID,
+	})
+	if marshalErr != nil {
+		return fmt.Errorf("failed to marshal async execution input: %s", marshalErr)
+	}
+
+	executionName := asyncIdempotencyKey(event)
+	svc := sfn.New(awsSession)
+	_, startErr := svc.StartExecution(&sfn.StartExecutionInput{
+		StateMachineArn: aws.String(stateMachineArn),
+		Name:            aws.String(executionName),
+		Input:           aws.String(string(input)),
+	})
+	if startErr != nil {
+		if awsErr, awsErrOk := startErr.(awserr.Error); awsErrOk && awsErr.Code() == sfn.ErrCodeExecutionAlreadyExists {
+			logger.WithField("ExecutionName", executionName).Info("async execution already started for this invocation; treating replay as a no-op")
+			return nil
+		}
+		return fmt.Errorf("failed to start async execution: %s", startErr)
+	}
+	logger.WithFields(logrus.Fields{
+		"StateMachineArn": stateMachineArn,
+		"ExecutionName":   executionName,
+	}).Info("started async custom resource execution")
+	return nil
+}
+
+// asyncNotifyRequest is the payload the terminal Lambda task state in an
+// async state machine receives once the provisioning work is done, so it
+// can relay the outcome back to the CloudFormation invocation that kicked
+// the execution off.
+type asyncNotifyRequest struct {
+	ResponseURL       string
+	StackID           string
+	RequestID         string
+	LogicalResourceID string
+	Success           bool
+	Data              map[string]interface{}
+}
+
+// asyncNotifyCloudFormation is the Lambda handler for the terminal task
+// state: it PUTs the final success/failure response to CloudFormation on
+// behalf of a state machine execution that long outlived the Lambda
+// invocation which started it.
+func asyncNotifyCloudFormation(ctx context.Context, request asyncNotifyRequest) error {
+	event := &spartaAWSResource.CloudFormationLambdaEvent{
+		ResponseURL:       request.ResponseURL,
+		StackID:           request.StackID,
+		RequestID:         request.RequestID,
+		LogicalResourceID: request.LogicalResourceID,
+	}
+	var responseErr error
+	if !request.Success {
+		responseErr = fmt.Errorf("async custom resource provisioning reported failure")
+	}
+	return spartaAWSResource.SendCloudFormationResponse(nil, event, request.Data, responseErr, logrus.New())
+}
+
+// asyncDispatchHandler is the Lambda CloudFormation invokes directly: it
+// starts the already-provisioned state machine (named by
+// asyncStateMachineArnEnvVar) and returns immediately, leaving
+// asyncNotifyCloudFormation to report the real outcome once the machine
+// finishes.
+func asyncDispatchHandler(ctx context.Context, event spartaAWSResource.CloudFormationLambdaEvent) error {
+	logger := logrus.New()
+	stateMachineArn := os.Getenv(asyncStateMachineArnEnvVar)
+	if stateMachineArn == "" {
+		return fmt.Errorf("%s environment variable is not set", asyncStateMachineArnEnvVar)
+	}
+	return startAsyncExecution(session.Must(session.NewSession()), stateMachineArn, &event, logger)
+}
+
+// ensureAsyncCustomResourceHandler wires machine into template via its own
+// StateMachineNamedDecorator hook - step.StateMachine has no AddToTemplate
+// method, so the state machine is provisioned the same way every other
+// Sparta-managed state machine is: as a ServiceDecorator.
+func ensureAsyncCustomResourceHandler(stateMachineResourceName string,
+	machine *step.StateMachine,
+	hooks *sparta.WorkflowHooks,
+	logger *logrus.Logger) error {
+
+	if machine == nil {
+		return fmt.Errorf("AsyncCreate/AsyncUpdate/AsyncDelete must return a non-nil *step.StateMachine")
+	}
+	hooks.ServiceDecorators = append(hooks.ServiceDecorators,
+		sparta.ServiceDecoratorHookFunc(machine.StateMachineNamedDecorator(stateMachineResourceName)))
+	logger.WithField("StateMachine", stateMachineResourceName).Info("provisioning async custom resource state machine")
+	return nil
+}
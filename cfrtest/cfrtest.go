@@ -0,0 +1,182 @@
+// Package cfrtest provides a local harness for exercising Sparta custom
+// resource lifecycle handlers without provisioning a real CloudFormation
+// stack. It synthesizes a CloudFormationLambdaEvent, stands up an in-process
+// httptest server to stand in for the pre-signed S3 ResponseURL, and drives
+// the Create/Update/Delete methods of a SpartaHelloWorldResource-shaped
+// struct directly.
+package cfrtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	spartaAWSResource "github.com/mweagle/Sparta/aws/cloudformation/resources"
+	"github.com/sirupsen/logrus"
+)
+
+// lifecycleResource is the subset of gocf.CloudFormationCustomResource's
+// contract LocalInvoke needs in order to drive a resource end to end.
+type lifecycleResource interface {
+	Create(awsSession *session.Session, event *spartaAWSResource.CloudFormationLambdaEvent, logger *logrus.Logger) (map[string]interface{}, error)
+	Update(awsSession *session.Session, event *spartaAWSResource.CloudFormationLambdaEvent, logger *logrus.Logger) (map[string]interface{}, error)
+	Delete(awsSession *session.Session, event *spartaAWSResource.CloudFormationLambdaEvent, logger *logrus.Logger) (map[string]interface{}, error)
+}
+
+// cfnResponse mirrors the body a custom resource PUTs to ResponseURL.
+type cfnResponse struct {
+	Status             string
+	Reason             string
+	PhysicalResourceId string
+	Data               map[string]interface{}
+}
+
+// mockResponseServer is an in-process stand-in for the pre-signed S3
+// ResponseURL CloudFormation gives every custom resource invocation.
+type mockResponseServer struct {
+	server   *httptest.Server
+	mu       sync.Mutex
+	received *cfnResponse
+}
+
+func newMockResponseServer() *mockResponseServer {
+	mock := &mockResponseServer{}
+	mock.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var response cfnResponse
+		decodeErr := json.NewDecoder(r.Body).Decode(&response)
+		mock.mu.Lock()
+		defer mock.mu.Unlock()
+		if decodeErr == nil {
+			mock.received = &response
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	return mock
+}
+
+func (mock *mockResponseServer) response() *cfnResponse {
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	return mock.received
+}
+
+func (mock *mockResponseServer) close() {
+	mock.server.Close()
+}
+
+// InvokeOptions configures a single LocalInvoke call.
+type InvokeOptions struct {
+	// StackId and LogicalResourceId identify the synthesized invocation.
+	// Reasonable defaults are used if left blank.
+	StackId           string
+	LogicalResourceId string
+	// Timeout bounds how long LocalInvoke waits for the resource's response,
+	// mirroring (at test scale) CloudFormation's real one-hour cap.
+	Timeout time.Duration
+}
+
+// LocalInvoke synthesizes a CloudFormationLambdaEvent for requestType
+// ("Create", "Update", or "Delete"), drives resource's matching lifecycle
+// method, and returns an error if the resource PUTs a FAILED status or
+// doesn't respond within opts.Timeout. Otherwise it returns the Data payload
+// from the resource's response.
+func LocalInvoke(resource lifecycleResource,
+	requestType string,
+	oldProps map[string]interface{},
+	newProps map[string]interface{},
+	opts InvokeOptions) (map[string]interface{}, error) {
+
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Hour
+	}
+	if opts.StackId == "" {
+		opts.StackId = "arn:aws:cloudformation:us-west-2:123456789012:stack/cfrtest-stack/local"
+	}
+	if opts.LogicalResourceId == "" {
+		opts.LogicalResourceId = "CfrtestResource"
+	}
+
+	mockServer := newMockResponseServer()
+	defer mockServer.close()
+
+	resourceProperties, marshalErr := json.Marshal(newProps)
+	if marshalErr != nil {
+		return nil, fmt.Errorf("failed to marshal ResourceProperties: %s", marshalErr)
+	}
+	var oldResourceProperties json.RawMessage
+	if oldProps != nil {
+		oldResourceProperties, marshalErr = json.Marshal(oldProps)
+		if marshalErr != nil {
+			return nil, fmt.Errorf("failed to marshal OldResourceProperties: %s", marshalErr)
+		}
+	}
+
+	event := &spartaAWSResource.CloudFormationLambdaEvent{
+		RequestType:           requestType,
+		ResponseURL:           mockServer.server.URL,
+		StackID:               opts.StackId,
+		RequestID:             fmt.Sprintf("local-%d", time.Now().UnixNano()),
+		LogicalResourceID:     opts.LogicalResourceId,
+		ResourceProperties:    resourceProperties,
+		OldResourceProperties: oldResourceProperties,
+	}
+
+	logger := logrus.New()
+	done := make(chan struct{})
+
+	var data map[string]interface{}
+	var invokeErr error
+	go func() {
+		switch requestType {
+		case "Create":
+			data, invokeErr = resource.Create(nil, event, logger)
+		case "Update":
+			data, invokeErr = resource.Update(nil, event, logger)
+		case "Delete":
+			data, invokeErr = resource.Delete(nil, event, logger)
+		default:
+			invokeErr = fmt.Errorf("unsupported RequestType: %s", requestType)
+		}
+		// Mirror spartaAWSResource.CloudFormationLambdaCustomResourceHandler:
+		// PUT the CloudFormation response the instant the lifecycle method
+		// returns, whether it succeeded or failed.
+		sendErr := spartaAWSResource.SendCloudFormationResponse(nil, event, data, invokeErr, logger)
+		if sendErr != nil {
+			logger.WithField("Error", sendErr).Warn("failed to PUT CloudFormation response")
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(opts.Timeout):
+		return nil, fmt.Errorf("resource did not respond within %s", opts.Timeout)
+	}
+
+	response := mockServer.response()
+	if response == nil {
+		return nil, fmt.Errorf("no CloudFormation response was PUT to ResponseURL")
+	}
+	if response.Status == "FAILED" {
+		return nil, fmt.Errorf("resource reported FAILED: %s", response.Reason)
+	}
+	if invokeErr != nil {
+		return nil, invokeErr
+	}
+	return data, nil
+}
+
+// AssertPhysicalResourceIdStable reports whether physicalResourceId is
+// unchanged between an Update's before/after PhysicalResourceId values. A
+// mismatch means CloudFormation would have issued an implicit Delete for the
+// old resource rather than reusing it in place.
+func AssertPhysicalResourceIdStable(before string, after string) error {
+	if before != after {
+		return fmt.Errorf("PhysicalResourceId changed from %q to %q; CloudFormation would issue an implicit Delete", before, after)
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	sparta "github.com/mweagle/Sparta"
+	spartaAWSResource "github.com/mweagle/Sparta/aws/cloudformation/resources"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Drift detection
+//
+// Custom resources that implement driftDetector are invoked on a schedule by
+// driftDetectionHandler, a standalone Lambda triggered by the CloudWatch
+// Events (EventBridge) rule ensureDriftDetectionHandler provisions. On each
+// invocation it scans the DynamoDB snapshot table for last-known-good
+// ResourceProperties (written by recordDriftSnapshot after every successful
+// Create/Update, keyed by StackId+LogicalResourceId) and hands each snapshot
+// to the matching resource's DriftDetect, so the resource only has to
+// describe the gap between what CloudFormation thinks it provisioned and
+// what the world looks like now.
+
+// driftSnapshotTableName is the name of the DynamoDB table
+// ensureDriftDetectionHandler provisions to hold ResourceProperties
+// snapshots, keyed by StackId+LogicalResourceId.
+const driftSnapshotTableName = "SpartaCustomResourceDriftSnapshots"
+
+// driftSnapshotTTLDays bounds how long a resource's last-known-good snapshot
+// is retained before the table's TTL attribute rolls it off.
+const driftSnapshotTTLDays = 30
+
+// driftDetectionSchedule controls how often driftDetectionHandler runs.
+const driftDetectionSchedule = "rate(1 day)"
+
+// DriftStatus enumerates the outcomes of a DriftDetect call.
+type DriftStatus string
+
+const (
+	// DriftStatusInSync indicates no difference was found
+	DriftStatusInSync DriftStatus = "IN_SYNC"
+	// DriftStatusDrifted indicates one or more properties diverged
+	DriftStatusDrifted DriftStatus = "DRIFTED"
+	// DriftStatusNotChecked indicates the resource could not be evaluated
+	DriftStatusNotChecked DriftStatus = "NOT_CHECKED"
+)
+
+// PropertyDifference mirrors the shape of a native
+// AWS::CloudFormation::PropertyDifference entry.
+type PropertyDifference struct {
+	PropertyPath   string
+	ExpectedValue  interface{}
+	ActualValue    interface{}
+	DifferenceType string
+}
+
+// driftDetector is implemented by custom resources that can compare their
+// last-known-good ResourceProperties against the actual state of the AWS
+// resources they provisioned.
+type driftDetector interface {
+	DriftDetect(awsSession *session.Session,
+		event *spartaAWSResource.CloudFormationLambdaEvent,
+		logger *logrus.Logger) (DriftStatus, []PropertyDifference, error)
+}
+
+// driftSnapshotRecord is the DynamoDB item shape for driftSnapshotTableName.
+// ResourceType is stored alongside the snapshot so driftDetectionHandler can
+// resolve the same gocf-registered factory the resource was created from,
+// instead of assuming every snapshot belongs to one hardcoded resource type.
+type driftSnapshotRecord struct {
+	SnapshotKey            string `dynamodbav:"SnapshotKey"`
+	StackID                string `dynamodbav:"StackId"`
+	LogicalResourceID      string `dynamodbav:"LogicalResourceId"`
+	ResourceType           string `dynamodbav:"ResourceType"`
+	ResourcePropertiesJSON string `dynamodbav:"ResourceProperties"`
+	ExpiresAt              int64  `dynamodbav:"ExpiresAt"`
+}
+
+// driftSnapshotKey is the DynamoDB partition key for a resource's
+// last-known-good ResourceProperties.
+func driftSnapshotKey(event *spartaAWSResource.CloudFormationLambdaEvent) string {
+	return fmt.Sprintf("%s::%s", event.StackID, event.LogicalResourceID)
+}
+
+// recordDriftSnapshot persists the current ResourceProperties as the new
+// last-known-good snapshot, called after every successful Create/Update so
+// the next Detect invocation has something recent to compare against.
+func recordDriftSnapshot(dynamoClient *dynamodb.DynamoDB,
+	event *spartaAWSResource.CloudFormationLambdaEvent,
+	nowUnix int64,
+	logger *logrus.Logger) error {
+
+	record := driftSnapshotRecord{
+		SnapshotKey:            driftSnapshotKey(event),
+		StackID:                event.StackID,
+		LogicalResourceID:      event.LogicalResourceID,
+		ResourceType:           event.ResourceType,
+		ResourcePropertiesJSON: string(event.ResourceProperties),
+		ExpiresAt:              nowUnix + int64(driftSnapshotTTLDays)*24*60*60,
+	}
+	item, marshalErr := dynamodbattribute.MarshalMap(record)
+	if marshalErr != nil {
+		return fmt.Errorf("failed to marshal drift snapshot: %s", marshalErr)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"Table": driftSnapshotTableName,
+		"Key":   record.SnapshotKey,
+	}).Info("recording drift snapshot")
+
+	_, putErr := dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(driftSnapshotTableName),
+		Item:      item,
+	})
+	return putErr
+}
+
+// driftDetectionHandler is the Lambda driftDetectionSchedule invokes. It
+// scans the snapshot table and runs DriftDetect for every resource that has
+// a last-known-good snapshot on file.
+func driftDetectionHandler(awsSession *session.Session, logger *logrus.Logger) error {
+	dynamoClient := dynamodb.New(awsSession)
+	scanOutput, scanErr := dynamoClient.Scan(&dynamodb.ScanInput{
+		TableName: aws.String(driftSnapshotTableName),
+	})
+	if scanErr != nil {
+		return fmt.Errorf("failed to scan drift snapshot table: %s", scanErr)
+	}
+
+	for _, item := range scanOutput.Items {
+		var record driftSnapshotRecord
+		unmarshalErr := dynamodbattribute.UnmarshalMap(item, &record)
+		if unmarshalErr != nil {
+			logger.WithField("Error", unmarshalErr).Warn("failed to unmarshal drift snapshot record")
+			continue
+		}
+
+		event := &spartaAWSResource.CloudFormationLambdaEvent{
+			RequestType:        "Detect",
+			StackID:            record.StackID,
+			LogicalResourceID:  record.LogicalResourceID,
+			ResourceType:       record.ResourceType,
+			ResourceProperties: json.RawMessage(record.ResourcePropertiesJSON),
+		}
+
+		resource := gocf.NewResourceByType(record.ResourceType)
+		if resource == nil {
+			logger.WithFields(logrus.Fields{
+				"LogicalResourceId": record.LogicalResourceID,
+				"ResourceType":      record.ResourceType,
+			}).Warn("no custom resource registered for snapshot's ResourceType; skipping")
+			continue
+		}
+		detector, detectorOk := resource.(driftDetector)
+		if !detectorOk {
+			logger.WithFields(logrus.Fields{
+				"LogicalResourceId": record.LogicalResourceID,
+				"ResourceType":      record.ResourceType,
+			}).Warn("resource type does not implement driftDetector; skipping")
+			continue
+		}
+
+		status, differences, detectErr := detector.DriftDetect(awsSession, event, logger)
+		if detectErr != nil {
+			logger.WithFields(logrus.Fields{
+				"LogicalResourceId": record.LogicalResourceID,
+				"Error":             detectErr,
+			}).Warn("drift detection failed")
+			continue
+		}
+		logger.WithFields(logrus.Fields{
+			"LogicalResourceId": record.LogicalResourceID,
+			"Status":            status,
+			"Differences":       differences,
+		}).Info("drift detection result")
+	}
+	return nil
+}
+
+// driftDetectionLambdaHandler is the Lambda entry point registered with
+// sparta.HandleAWSLambda; it builds its own session since the scheduled
+// CloudWatch Events rule doesn't pass one.
+func driftDetectionLambdaHandler(ctx context.Context) error {
+	logger := logrus.New()
+	return driftDetectionHandler(session.Must(session.NewSession()), logger)
+}
+
+// ensureDriftDetectionHandler provisions the snapshot table (with its TTL
+// attribute) and the CloudWatch Events rule that invokes
+// driftDetectionLogicalName on driftDetectionSchedule, mirroring
+// sparta.EnsureCustomResourceHandler's role for ordinary lifecycle events.
+func ensureDriftDetectionHandler(serviceName string,
+	driftDetectionLogicalName string,
+	template *gocf.Template,
+	logger *logrus.Logger) error {
+
+	snapshotTable := &gocf.DynamoDBTable{
+		TableName: gocf.String(driftSnapshotTableName),
+		AttributeDefinitions: &gocf.DynamoDBTableAttributeDefinitionList{
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String("SnapshotKey"),
+				AttributeType: gocf.String("S"),
+			},
+		},
+		KeySchema: &gocf.DynamoDBTableKeySchemaList{
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String("SnapshotKey"),
+				KeyType:       gocf.String("HASH"),
+			},
+		},
+		BillingMode: gocf.String("PAY_PER_REQUEST"),
+		TimeToLiveSpecification: &gocf.DynamoDBTableTimeToLiveSpecification{
+			AttributeName: gocf.String("ExpiresAt"),
+			Enabled:       gocf.Bool(true),
+		},
+	}
+	tableResourceName := sparta.CloudFormationResourceName(driftSnapshotTableName, serviceName)
+	template.AddResource(tableResourceName, snapshotTable)
+
+	ruleResourceName := sparta.CloudFormationResourceName("SpartaCustomResourceDriftSchedule", serviceName)
+	scheduleRule := &gocf.EventsRule{
+		ScheduleExpression: gocf.String(driftDetectionSchedule),
+		State:              gocf.String("ENABLED"),
+		Targets: &gocf.EventsRuleTargetList{
+			gocf.EventsRuleTarget{
+				ID:  gocf.String(driftDetectionLogicalName),
+				Arn: gocf.GetAtt(driftDetectionLogicalName, "Arn"),
+			},
+		},
+	}
+	template.AddResource(ruleResourceName, scheduleRule)
+
+	permissionResourceName := sparta.CloudFormationResourceName("SpartaCustomResourceDriftPermission", serviceName)
+	invokePermission := &gocf.LambdaPermission{
+		Action:       gocf.String("lambda:InvokeFunction"),
+		FunctionName: gocf.GetAtt(driftDetectionLogicalName, "Arn"),
+		Principal:    gocf.String("events.amazonaws.com"),
+		SourceArn:    gocf.GetAtt(ruleResourceName, "Arn"),
+	}
+	template.AddResource(permissionResourceName, invokePermission)
+
+	logger.WithFields(logrus.Fields{
+		"Table":    tableResourceName,
+		"Rule":     ruleResourceName,
+		"Resource": driftDetectionLogicalName,
+	}).Info("provisioned drift detection snapshot table and schedule")
+	return nil
+}
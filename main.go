@@ -2,22 +2,24 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	_ "net/http/pprof" // include pprop
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	sparta "github.com/mweagle/Sparta"
 	spartaCF "github.com/mweagle/Sparta/aws/cloudformation"
 	spartaAWSResource "github.com/mweagle/Sparta/aws/cloudformation/resources"
+	"github.com/mweagle/Sparta/aws/step"
 	gocf "github.com/mweagle/go-cloudformation"
 	"github.com/sirupsen/logrus"
 )
 
-////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////
 // Lambda Function
-////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////
 func helloWorld(ctx context.Context) (string, error) {
 	logger, loggerOk := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
 	if loggerOk {
@@ -40,7 +42,7 @@ func helloWorld(ctx context.Context) (string, error) {
 //
 ////////////////////////////////////////////////////////////////////////////////
 
-////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////
 // 1 - Define the custom type
 const spartaHelloWorldResourceType = "Custom::sparta::HelloWorldResource"
 
@@ -63,62 +65,236 @@ type SpartaHelloWorldResource struct {
 	SpartaCustomResourceRequest
 }
 
+// ValidateRequest implements the optional requestValidator interface so that
+// semantic checks beyond the JSON Schema (e.g. Message content constraints)
+// are enforced before Create/Update/Delete run.
+func (command SpartaHelloWorldResource) ValidateRequest() error {
+	if command.Message == nil || command.Message.Literal == "" {
+		return fmt.Errorf("Message property must be a non-empty string")
+	}
+	return nil
+}
+
+// schemaValidated wraps command in a SchemaValidatedResource bound to
+// helloWorldResourceSchema, so Create/Update/Delete all get schema
+// validation for free instead of each calling validateResourceProperties
+// itself. DriftDetect is not routed through it and validates on its own.
+func (command *SpartaHelloWorldResource) schemaValidated() *SchemaValidatedResource {
+	return &SchemaValidatedResource{
+		Schema: helloWorldResourceSchema,
+		Target: command,
+		OnCreate: func(awsSession *session.Session,
+			event *spartaAWSResource.CloudFormationLambdaEvent,
+			logger *logrus.Logger) (map[string]interface{}, error) {
+
+			logger.Info("create: ", command.Message.Literal)
+			// awsSession is nil for local/test invocations (see
+			// cfrtest.LocalInvoke); there's no snapshot table to write to
+			// without one.
+			if awsSession != nil {
+				snapshotErr := recordDriftSnapshot(dynamodb.New(awsSession), event, time.Now().Unix(), logger)
+				if snapshotErr != nil {
+					return nil, snapshotErr
+				}
+			}
+			return map[string]interface{}{
+				"Resource": "Created message: " + command.Message.Literal,
+			}, nil
+		},
+		OnUpdate: func(awsSession *session.Session,
+			event *spartaAWSResource.CloudFormationLambdaEvent,
+			diffs []PropertyDiff,
+			logger *logrus.Logger) (map[string]interface{}, error) {
+
+			for _, diff := range diffs {
+				logger.WithFields(logrus.Fields{
+					"Property": diff.PropertyName,
+					"OldValue": diff.OldValue,
+					"NewValue": diff.NewValue,
+				}).Info("update: property changed")
+			}
+			logger.Info("update: ", command.Message.Literal)
+			if awsSession != nil {
+				snapshotErr := recordDriftSnapshot(dynamodb.New(awsSession), event, time.Now().Unix(), logger)
+				if snapshotErr != nil {
+					return nil, snapshotErr
+				}
+			}
+			return nil, nil
+		},
+		OnDelete: func(awsSession *session.Session,
+			event *spartaAWSResource.CloudFormationLambdaEvent,
+			logger *logrus.Logger) (map[string]interface{}, error) {
+
+			logger.Info("delete: ", command.Message.Literal)
+			return nil, nil
+		},
+	}
+}
+
 // Create implements resource create
-func (command SpartaHelloWorldResource) Create(awsSession *session.Session,
+func (command *SpartaHelloWorldResource) Create(awsSession *session.Session,
 	event *spartaAWSResource.CloudFormationLambdaEvent,
 	logger *logrus.Logger) (map[string]interface{}, error) {
-
-	requestPropsErr := json.Unmarshal(event.ResourceProperties, &command)
-	if requestPropsErr != nil {
-		return nil, requestPropsErr
-	}
-	logger.Info("create: ", command.Message.Literal)
-	return map[string]interface{}{
-		"Resource": "Created message: " + command.Message.Literal,
-	}, nil
+	return command.schemaValidated().Create(awsSession, event, logger)
 }
 
 // Update implements resource update
-func (command SpartaHelloWorldResource) Update(awsSession *session.Session,
+func (command *SpartaHelloWorldResource) Update(awsSession *session.Session,
 	event *spartaAWSResource.CloudFormationLambdaEvent,
 	logger *logrus.Logger) (map[string]interface{}, error) {
-	requestPropsErr := json.Unmarshal(event.ResourceProperties, &command)
-	if requestPropsErr != nil {
-		return nil, requestPropsErr
-	}
-
-	logger.Info("update: ", command.Message.Literal)
-	return nil, nil
+	return command.schemaValidated().Update(awsSession, event, logger)
 }
 
 // Delete implements resource delete
-func (command SpartaHelloWorldResource) Delete(awsSession *session.Session,
+func (command *SpartaHelloWorldResource) Delete(awsSession *session.Session,
 	event *spartaAWSResource.CloudFormationLambdaEvent,
 	logger *logrus.Logger) (map[string]interface{}, error) {
-	requestPropsErr := json.Unmarshal(event.ResourceProperties, &command)
+	return command.schemaValidated().Delete(awsSession, event, logger)
+}
+
+// DriftDetect implements driftDetector. SpartaHelloWorldResource doesn't
+// provision anything outside of its own ResourceProperties, so there's
+// nothing in AWS to compare against; it reports in sync whenever the
+// snapshot's ResourceProperties pass validation, and NOT_CHECKED with the
+// validation error otherwise. A resource
+// that manages real infrastructure (e.g. an S3 bucket policy) would fetch
+// the live configuration here and diff it against event.ResourceProperties.
+func (command *SpartaHelloWorldResource) DriftDetect(awsSession *session.Session,
+	event *spartaAWSResource.CloudFormationLambdaEvent,
+	logger *logrus.Logger) (DriftStatus, []PropertyDifference, error) {
+
+	requestPropsErr := validateResourceProperties(helloWorldResourceSchema,
+		event.ResourceProperties,
+		command)
 	if requestPropsErr != nil {
-		return nil, requestPropsErr
+		return DriftStatusNotChecked, nil, requestPropsErr
 	}
-	logger.Info("delete: ", command.Message.Literal)
-	return nil, nil
+	return DriftStatusInSync, nil, nil
 }
 
-////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////
+// 3b - An async variant that provisions via a Step Functions state machine
+// rather than returning synchronously. See async.go for the runtime side
+// of this (asyncDispatchHandler, asyncNotifyCloudFormation).
+const spartaAsyncHelloWorldResourceType = "Custom::sparta::AsyncHelloWorldResource"
+const spartaAsyncStateMachineResourceName = "SpartaAsyncHelloWorldStateMachine"
+
+// SpartaAsyncHelloWorldResource is a POC showing how a custom resource
+// describes its provisioning as a state machine instead of doing the work
+// inline. All three lifecycle operations reuse the same single-task
+// machine here; a real resource would give Create/Update/Delete distinct
+// topologies.
+type SpartaAsyncHelloWorldResource struct {
+	gocf.CloudFormationCustomResource
+	SpartaCustomResourceRequest
+}
+
+func (command SpartaAsyncHelloWorldResource) notifyStateMachine(logger *logrus.Logger) (*step.StateMachine, error) {
+	if asyncNotifyLambdaInfo == nil {
+		return nil, fmt.Errorf("asyncNotifyLambdaInfo has not been registered yet")
+	}
+	return step.NewStateMachine(spartaAsyncStateMachineResourceName,
+		step.NewLambdaTaskState("NotifyCloudFormation", asyncNotifyLambdaInfo)), nil
+}
+
+// AsyncCreate implements asyncResourceHandler
+func (command SpartaAsyncHelloWorldResource) AsyncCreate(logger *logrus.Logger) (*step.StateMachine, error) {
+	return command.notifyStateMachine(logger)
+}
+
+// AsyncUpdate implements asyncResourceHandler
+func (command SpartaAsyncHelloWorldResource) AsyncUpdate(logger *logrus.Logger) (*step.StateMachine, error) {
+	return command.notifyStateMachine(logger)
+}
+
+// AsyncDelete implements asyncResourceHandler
+func (command SpartaAsyncHelloWorldResource) AsyncDelete(logger *logrus.Logger) (*step.StateMachine, error) {
+	return command.notifyStateMachine(logger)
+}
+
+// //////////////////////////////////////////////////////////////////////////////
 // 4 - Register the CloudFormation custom type provider
 func init() {
 	customResourceFactory := func(resourceType string) gocf.ResourceProperties {
 		switch resourceType {
 		case spartaHelloWorldResourceType:
 			return &SpartaHelloWorldResource{}
+		case spartaAsyncHelloWorldResourceType:
+			return &SpartaAsyncHelloWorldResource{}
 		}
 		return nil
 	}
 	gocf.RegisterCustomResourceProvider(customResourceFactory)
 }
 
-////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////
 // 5 - Hook it up
-func customResourceHooks() *sparta.WorkflowHooks {
+//
+// lambdaFunctions is a pointer since the async dispatch/notify Lambdas this
+// function registers (and, once multiplexing kicks in, the custom resource
+// dispatcher Lambda) must end up in the same slice main() hands to
+// sparta.MainEx, not just in the template decorator closure. multiplexPolicy
+// is threaded straight into the returned hooks' CustomResourceMultiplexPolicy;
+// pass 0 to fall back to customResourceMultiplexThreshold.
+func customResourceHooks(lambdaFunctions *[]*sparta.LambdaAWSInfo, multiplexPolicy int) *CustomResourceWorkflowHooks {
+	hooks := &CustomResourceWorkflowHooks{
+		WorkflowHooks:                 &sparta.WorkflowHooks{},
+		CustomResourceMultiplexPolicy: multiplexPolicy,
+	}
+
+	// Register the async resource's terminal notify Lambda and its dispatch
+	// Lambda up front so their logical names/ARNs are available both to the
+	// state machine builder below and to the decorator that declares the
+	// Custom::sparta::AsyncHelloWorldResource invocation.
+	asyncNotifyLambdaInfo = sparta.HandleAWSLambda("Async Notify CloudFormation",
+		asyncNotifyCloudFormation,
+		sparta.IAMRoleDefinition{})
+
+	asyncDispatchLambdaInfo := sparta.HandleAWSLambda("Async Dispatch CloudFormation",
+		asyncDispatchHandler,
+		sparta.IAMRoleDefinition{
+			Privileges: []sparta.IAMRolePrivilege{
+				{
+					Actions:  []string{"states:StartExecution"},
+					Resource: gocf.Ref(spartaAsyncStateMachineResourceName).String(),
+				},
+			},
+		})
+	asyncDispatchLambdaInfo.Options.Environment[asyncStateMachineArnEnvVar] =
+		gocf.Ref(spartaAsyncStateMachineResourceName).String()
+
+	*lambdaFunctions = append(*lambdaFunctions, asyncNotifyLambdaInfo, asyncDispatchLambdaInfo)
+
+	// Register the scheduled drift detection Lambda; ensureDriftDetectionHandler
+	// (called from the decorator below) provisions the DynamoDB snapshot
+	// table and the CloudWatch Events rule that invokes it.
+	driftDetectionLambdaInfo := sparta.HandleAWSLambda("Drift Detection",
+		driftDetectionLambdaHandler,
+		sparta.IAMRoleDefinition{
+			Privileges: []sparta.IAMRolePrivilege{
+				{
+					Actions:  []string{"dynamodb:Scan"},
+					Resource: gocf.String("*"),
+				},
+			},
+		})
+	*lambdaFunctions = append(*lambdaFunctions, driftDetectionLambdaInfo)
+
+	// Provision the state machine itself alongside the Lambdas above.
+	asyncResource := &SpartaAsyncHelloWorldResource{}
+	asyncMachine, asyncMachineErr := asyncResource.AsyncCreate(logrus.New())
+	if asyncMachineErr != nil {
+		panic(asyncMachineErr)
+	}
+	ensureErr := ensureAsyncCustomResourceHandler(spartaAsyncStateMachineResourceName,
+		asyncMachine,
+		hooks.WorkflowHooks,
+		logrus.New())
+	if ensureErr != nil {
+		panic(ensureErr)
+	}
+
 	// Add the custom resource decorator
 	customResourceDecorator := func(context map[string]interface{},
 		serviceName string,
@@ -130,16 +306,36 @@ func customResourceHooks() *sparta.WorkflowHooks {
 		noop bool,
 		logger *logrus.Logger) error {
 
-		// 1. Ensure the Lambda Function is registered
-		customResourceName, customResourceNameErr := sparta.EnsureCustomResourceHandler(serviceName,
-			spartaHelloWorldResourceType,
-			nil, // This custom action doesn't need to access other AWS resources
-			[]string{},
-			template,
-			S3Bucket,
-			S3Key,
-			logger)
-
+		// 1. Ensure the synchronous Lambda Function is registered. Once this
+		// service registers more Custom::sparta::* types than
+		// hooks.CustomResourceMultiplexPolicy allows, collapse them behind a
+		// single dispatcher Lambda instead of paying for one Lambda per type.
+		syncResourceTypes := []customResourceTypeBinding{
+			{
+				ResourceType: spartaHelloWorldResourceType,
+				FactoryFn:    func() gocf.ResourceProperties { return &SpartaHelloWorldResource{} },
+			},
+		}
+		var customResourceName string
+		var customResourceNameErr error
+		if shouldMultiplexCustomResources(len(syncResourceTypes), hooks.CustomResourceMultiplexPolicy) {
+			dispatcherLambdaInfo, dispatcherErr := ensureCustomResourceMultiplexer(lambdaFunctions,
+				syncResourceTypes,
+				logger)
+			if dispatcherErr != nil {
+				return dispatcherErr
+			}
+			customResourceName = dispatcherLambdaInfo.LogicalResourceName()
+		} else {
+			customResourceName, customResourceNameErr = sparta.EnsureCustomResourceHandler(serviceName,
+				spartaHelloWorldResourceType,
+				nil, // This custom action doesn't need to access other AWS resources
+				[]string{},
+				template,
+				S3Bucket,
+				S3Key,
+				logger)
+		}
 		if customResourceNameErr != nil {
 			return customResourceNameErr
 		}
@@ -156,17 +352,35 @@ func customResourceHooks() *sparta.WorkflowHooks {
 
 		// Add it
 		template.AddResource(resourceInvokerName, spartaCustomResource)
+
+		// 3. Declare the async custom resource invocation, pointed at the
+		// dispatch Lambda registered above
+		asyncCustomResource := &SpartaAsyncHelloWorldResource{}
+		asyncCustomResource.ServiceToken = gocf.GetAtt(asyncDispatchLambdaInfo.LogicalResourceName(), "Arn")
+		asyncCustomResource.Message = gocf.String("Async custom resource activated!")
+
+		asyncResourceInvokerName := sparta.CloudFormationResourceName("SpartaAsyncCustomResource",
+			fmt.Sprintf("%v", S3Bucket),
+			fmt.Sprintf("%v", S3Key))
+		template.AddResource(asyncResourceInvokerName, asyncCustomResource)
+
+		// 4. Provision the drift detection snapshot table and its schedule
+		driftErr := ensureDriftDetectionHandler(serviceName,
+			driftDetectionLambdaInfo.LogicalResourceName(),
+			template,
+			logger)
+		if driftErr != nil {
+			return driftErr
+		}
 		return nil
 	}
 	// Add the decorator to the template
-	hooks := &sparta.WorkflowHooks{}
-	hooks.ServiceDecorators = []sparta.ServiceDecoratorHookHandler{
-		sparta.ServiceDecoratorHookFunc(customResourceDecorator),
-	}
+	hooks.ServiceDecorators = append(hooks.ServiceDecorators,
+		sparta.ServiceDecoratorHookFunc(customResourceDecorator))
 	return hooks
 }
 
-////////////////////////////////////////////////////////////////////////////////
+// //////////////////////////////////////////////////////////////////////////////
 // Main
 func main() {
 	lambdaFn := sparta.HandleAWSLambda("Hello World",
@@ -185,16 +399,19 @@ func main() {
 	var lambdaFunctions []*sparta.LambdaAWSInfo
 	lambdaFunctions = append(lambdaFunctions, lambdaFn)
 
-	// Setup the CustomResource WorkflowHooks to annotate
-	// the template with the custom resource invocation
-	hooks := customResourceHooks()
+	// Setup the CustomResource WorkflowHooks to annotate the template with
+	// the custom resource invocation. 0 leaves CustomResourceMultiplexPolicy
+	// at its customResourceMultiplexThreshold default; pass a different
+	// count here to change how many Custom::sparta::* types this service
+	// tolerates before they're collapsed behind a shared dispatcher Lambda.
+	hooks := customResourceHooks(&lambdaFunctions, 0)
 
 	err := sparta.MainEx(awsName,
 		"Simple Sparta App that uses a Lambda Custom Resource",
 		lambdaFunctions,
 		nil,
 		nil,
-		hooks,
+		hooks.WorkflowHooks,
 		false)
 	if err != nil {
 		os.Exit(1)
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mweagle/SpartaCustomResource/cfrtest"
+)
+
+func TestSpartaHelloWorldResourceCreate(t *testing.T) {
+	resource := &SpartaHelloWorldResource{}
+	data, err := cfrtest.LocalInvoke(resource,
+		"Create",
+		nil,
+		map[string]interface{}{
+			"Message": "Custom resource activated!",
+		},
+		cfrtest.InvokeOptions{})
+	if err != nil {
+		t.Fatalf("Create invocation failed: %s", err)
+	}
+	if data["Resource"] != "Created message: Custom resource activated!" {
+		t.Fatalf("unexpected Create response data: %v", data)
+	}
+}
+
+func TestSpartaHelloWorldResourceCreateRejectsMissingMessage(t *testing.T) {
+	resource := &SpartaHelloWorldResource{}
+	_, err := cfrtest.LocalInvoke(resource,
+		"Create",
+		nil,
+		map[string]interface{}{},
+		cfrtest.InvokeOptions{})
+	if err == nil {
+		t.Fatal("expected Create to fail schema validation for a missing Message property")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	sparta "github.com/mweagle/Sparta"
+	spartaAWSResource "github.com/mweagle/Sparta/aws/cloudformation/resources"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Custom resource multiplexing
+//
+// sparta.EnsureCustomResourceHandler provisions one Lambda (and IAM role) per
+// custom resource type, which is fine for a single resource like
+// SpartaHelloWorldResource but bloats the template once a service grows past
+// a handful of Custom::sparta::* types. EnsureCustomResourceHandler can't be
+// reused to share one Lambda across types, though: it bakes the type name
+// into the Lambda's SPARTA_CUSTOM_RESOURCE_TYPE environment variable at
+// template-build time, and Sparta's generated entry point resolves the
+// resource from that environment variable rather than from
+// event.ResourceType at invocation time. ensureCustomResourceMultiplexer
+// instead registers its own Lambda, customResourceMultiplexHandler, whose
+// body reads event.ResourceType itself and looks up the matching factory
+// from gocf's CustomResourceProvider registry, so one Lambda genuinely
+// handles any number of types.
+
+// customResourceMultiplexThreshold is the default number of custom resource
+// types above which they're collapsed behind a single dispatcher Lambda. It's the fallback CustomResourceWorkflowHooks'
+// CustomResourceMultiplexPolicy uses when left unset.
+const customResourceMultiplexThreshold = 3
+
+// CustomResourceWorkflowHooks wraps sparta.WorkflowHooks with the
+// CustomResourceMultiplexPolicy knob, since sparta.WorkflowHooks itself
+// can't be extended with new fields.
+type CustomResourceWorkflowHooks struct {
+	*sparta.WorkflowHooks
+	// CustomResourceMultiplexPolicy is the number of Custom::sparta::* types
+	// above which they're collapsed behind a single dispatcher Lambda; every
+	// type counts, whatever its IAM policy shape.
+	// customResourceMultiplexThreshold is used if this is <= 0.
+	CustomResourceMultiplexPolicy int
+}
+
+// customResourceTypeBinding pairs a registered Custom::sparta::* resource
+// type with the factory function gocf.RegisterCustomResourceProvider already
+// knows how to build it with.
+type customResourceTypeBinding struct {
+	ResourceType string
+	FactoryFn    func() gocf.ResourceProperties
+}
+
+// customResourceMultiplexHandler is the Lambda entry point registered with
+// sparta.HandleAWSLambda by ensureCustomResourceMultiplexer. Unlike the
+// Lambda sparta.EnsureCustomResourceHandler generates, it resolves the
+// CustomResourceCommand to invoke from event.ResourceType at invocation
+// time, so the same Lambda can serve every type bound in
+// ensureCustomResourceMultiplexer's resourceTypes.
+func customResourceMultiplexHandler(ctx context.Context, event spartaAWSResource.CloudFormationLambdaEvent) error {
+	logger := logrus.New()
+
+	resourceProperties := gocf.NewResourceByType(event.ResourceType)
+	if resourceProperties == nil {
+		return fmt.Errorf("no custom resource registered for ResourceType %q", event.ResourceType)
+	}
+	command, commandOk := resourceProperties.(spartaAWSResource.CustomResourceCommand)
+	if !commandOk {
+		return fmt.Errorf("resource type %q does not implement CustomResourceCommand", event.ResourceType)
+	}
+
+	lifecycleHandler, handlerOk := spartaAWSResource.CloudFormationLambdaCustomResourceHandler(command, logger).(func(context.Context, spartaAWSResource.CloudFormationLambdaEvent) error)
+	if !handlerOk {
+		return fmt.Errorf("CloudFormationLambdaCustomResourceHandler returned an unexpected handler type")
+	}
+	return lifecycleHandler(ctx, event)
+}
+
+// ensureCustomResourceMultiplexer registers a single dispatcher Lambda that
+// serves every type in resourceTypes, appends it to lambdaFunctions (so
+// main() hands it to sparta.MainEx alongside the rest), and returns it so
+// the caller can point a Custom::sparta::* resource's ServiceToken at its
+// ARN.
+func ensureCustomResourceMultiplexer(lambdaFunctions *[]*sparta.LambdaAWSInfo,
+	resourceTypes []customResourceTypeBinding,
+	logger *logrus.Logger) (*sparta.LambdaAWSInfo, error) {
+
+	if len(resourceTypes) == 0 {
+		return nil, fmt.Errorf("ensureCustomResourceMultiplexer requires at least one resource type")
+	}
+
+	dispatcherLambdaInfo := sparta.HandleAWSLambda("Custom Resource Multiplexer",
+		customResourceMultiplexHandler,
+		sparta.IAMRoleDefinition{})
+	*lambdaFunctions = append(*lambdaFunctions, dispatcherLambdaInfo)
+
+	for _, binding := range resourceTypes {
+		binding := binding
+		gocf.RegisterCustomResourceProvider(func(requestedType string) gocf.ResourceProperties {
+			if requestedType == binding.ResourceType {
+				return binding.FactoryFn()
+			}
+			return nil
+		})
+	}
+
+	logger.WithFields(logrus.Fields{
+		"Dispatcher":    dispatcherLambdaInfo.LogicalResourceName(),
+		"ResourceTypes": len(resourceTypes),
+	}).Info("multiplexed custom resource types behind a single dispatcher Lambda")
+	return dispatcherLambdaInfo, nil
+}
+
+// shouldMultiplexCustomResources applies the
+// CustomResourceWorkflowHooks.CustomResourceMultiplexPolicy heuristic: types
+// are collapsed behind one Lambda once resourceTypeCount exceeds policy
+// (customResourceMultiplexThreshold if policy <= 0). It compares counts
+// only; the types' IAM policy shapes are not examined.
+func shouldMultiplexCustomResources(resourceTypeCount int, policy int) bool {
+	if policy <= 0 {
+		policy = customResourceMultiplexThreshold
+	}
+	return resourceTypeCount > policy
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	spartaAWSResource "github.com/mweagle/Sparta/aws/cloudformation/resources"
+	"github.com/sirupsen/logrus"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Schema-validated custom resource contract
+//
+// SpartaHelloWorldResource's ResourceProperties are validated against
+// helloWorldResourceSchema before Create/Update/Delete ever see them. That
+// keeps the handlers free of defensive `json.Unmarshal` error paths and
+// ensures a malformed template update fails fast with a descriptive
+// `Reason`, instead of leaving the stack in UPDATE_ROLLBACK_FAILED.
+
+// helloWorldResourceSchema describes the shape of SpartaCustomResourceRequest
+var helloWorldResourceSchema = []byte(`{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"type": "object",
+	"properties": {
+		"Message": {
+			"type": "string",
+			"minLength": 1
+		}
+	},
+	"required": ["Message"]
+}`)
+
+// PropertyDiff describes a single ResourceProperties field whose value
+// changed between OldResourceProperties and ResourceProperties on an Update
+// invocation.
+type PropertyDiff struct {
+	PropertyName string
+	OldValue     interface{}
+	NewValue     interface{}
+}
+
+// diffResourceProperties compares oldProperties and newProperties and returns
+// the set of top-level fields whose values differ, so Update handlers can
+// react to only the mutated fields instead of re-parsing everything.
+func diffResourceProperties(oldProperties json.RawMessage, newProperties json.RawMessage) ([]PropertyDiff, error) {
+	var oldValues map[string]interface{}
+	var newValues map[string]interface{}
+
+	if len(oldProperties) != 0 {
+		if unmarshalErr := json.Unmarshal(oldProperties, &oldValues); unmarshalErr != nil {
+			return nil, fmt.Errorf("failed to unmarshal OldResourceProperties: %s", unmarshalErr)
+		}
+	}
+	if unmarshalErr := json.Unmarshal(newProperties, &newValues); unmarshalErr != nil {
+		return nil, fmt.Errorf("failed to unmarshal ResourceProperties: %s", unmarshalErr)
+	}
+
+	propertyNames := make(map[string]struct{}, len(oldValues)+len(newValues))
+	for propertyName := range oldValues {
+		propertyNames[propertyName] = struct{}{}
+	}
+	for propertyName := range newValues {
+		propertyNames[propertyName] = struct{}{}
+	}
+
+	var diffs []PropertyDiff
+	for propertyName := range propertyNames {
+		oldValue, oldExisted := oldValues[propertyName]
+		newValue, newExisted := newValues[propertyName]
+		if !oldExisted || !newExisted || !reflect.DeepEqual(oldValue, newValue) {
+			diffs = append(diffs, PropertyDiff{
+				PropertyName: propertyName,
+				OldValue:     oldValue,
+				NewValue:     newValue,
+			})
+		}
+	}
+	return diffs, nil
+}
+
+// requestValidator is implemented by custom resources that want semantic
+// checks beyond what the JSON Schema can express (cross-field constraints,
+// lookups against other ResourceProperties, etc).
+type requestValidator interface {
+	ValidateRequest() error
+}
+
+// validateResourceProperties checks rawProperties against schema and, if
+// target also implements requestValidator, runs the semantic check. The
+// returned error's message is suitable for use directly as the CloudFormation
+// response Reason.
+func validateResourceProperties(schema []byte, rawProperties json.RawMessage, target interface{}) error {
+	schemaLoader := gojsonschema.NewBytesLoader(schema)
+	documentLoader := gojsonschema.NewBytesLoader(rawProperties)
+
+	result, resultErr := gojsonschema.Validate(schemaLoader, documentLoader)
+	if resultErr != nil {
+		return fmt.Errorf("failed to evaluate ResourceProperties schema: %s", resultErr)
+	}
+	if !result.Valid() {
+		return fmt.Errorf("ResourceProperties failed schema validation: %s", result.Errors()[0].String())
+	}
+
+	unmarshalErr := json.Unmarshal(rawProperties, target)
+	if unmarshalErr != nil {
+		return fmt.Errorf("failed to unmarshal ResourceProperties: %s", unmarshalErr)
+	}
+	if validator, validatorOk := target.(requestValidator); validatorOk {
+		return validator.ValidateRequest()
+	}
+	return nil
+}
+
+// SchemaValidatedResource decorates a resource's Create/Update/Delete logic
+// with JSON Schema validation, run once against event.ResourceProperties
+// before OnCreate/OnUpdate/OnDelete see it, instead of each lifecycle method
+// calling validateResourceProperties redundantly. OnUpdate additionally
+// receives the diff between OldResourceProperties and ResourceProperties as
+// a typed []PropertyDiff, so callers don't have to re-derive it themselves.
+type SchemaValidatedResource struct {
+	// Schema is the JSON Schema event.ResourceProperties must satisfy.
+	Schema []byte
+	// Target receives the unmarshaled ResourceProperties; it's typically the
+	// same value whose Create/Update/Delete methods call into this struct.
+	// If Target also implements requestValidator, ValidateRequest runs after
+	// schema validation succeeds.
+	Target   interface{}
+	OnCreate func(awsSession *session.Session, event *spartaAWSResource.CloudFormationLambdaEvent, logger *logrus.Logger) (map[string]interface{}, error)
+	OnUpdate func(awsSession *session.Session, event *spartaAWSResource.CloudFormationLambdaEvent, diffs []PropertyDiff, logger *logrus.Logger) (map[string]interface{}, error)
+	OnDelete func(awsSession *session.Session, event *spartaAWSResource.CloudFormationLambdaEvent, logger *logrus.Logger) (map[string]interface{}, error)
+}
+
+// Create validates event.ResourceProperties against Schema and, if it
+// passes, delegates to OnCreate.
+func (decorated *SchemaValidatedResource) Create(awsSession *session.Session,
+	event *spartaAWSResource.CloudFormationLambdaEvent,
+	logger *logrus.Logger) (map[string]interface{}, error) {
+
+	if validateErr := validateResourceProperties(decorated.Schema, event.ResourceProperties, decorated.Target); validateErr != nil {
+		return nil, validateErr
+	}
+	return decorated.OnCreate(awsSession, event, logger)
+}
+
+// Update validates event.ResourceProperties against Schema, computes the
+// diff against OldResourceProperties, and delegates to OnUpdate.
+func (decorated *SchemaValidatedResource) Update(awsSession *session.Session,
+	event *spartaAWSResource.CloudFormationLambdaEvent,
+	logger *logrus.Logger) (map[string]interface{}, error) {
+
+	if validateErr := validateResourceProperties(decorated.Schema, event.ResourceProperties, decorated.Target); validateErr != nil {
+		return nil, validateErr
+	}
+	diffs, diffErr := diffResourceProperties(event.OldResourceProperties, event.ResourceProperties)
+	if diffErr != nil {
+		return nil, diffErr
+	}
+	return decorated.OnUpdate(awsSession, event, diffs, logger)
+}
+
+// Delete validates event.ResourceProperties against Schema and, if it
+// passes, delegates to OnDelete.
+func (decorated *SchemaValidatedResource) Delete(awsSession *session.Session,
+	event *spartaAWSResource.CloudFormationLambdaEvent,
+	logger *logrus.Logger) (map[string]interface{}, error) {
+
+	if validateErr := validateResourceProperties(decorated.Schema, event.ResourceProperties, decorated.Target); validateErr != nil {
+		return nil, validateErr
+	}
+	return decorated.OnDelete(awsSession, event, logger)
+}